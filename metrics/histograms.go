@@ -1,155 +1,481 @@
 package metrics
 
 import (
-	"bytes"
-	crand "crypto/rand"
-	"encoding/binary"
+	"fmt"
+	"io"
 	"math"
-	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 )
 
 const (
-	numHists   = 100
-	buflen     = 0x3FFF // 16384 entries
-	sampleRate = 0.25   // sample 1 out of every 4 observations
+	buflen = 0x3FFF // 16384 entries
 )
 
+// registry holds the current *histRegistry. ObserveHist and the other
+// reader paths load it with a single atomic pointer read and never block;
+// registerHist does the copy-on-write append and swaps the pointer in,
+// serialized by registerMu against concurrent registrations.
 var (
-	hnames    = make([]string, numHists)
-	hists     = make([]*hist, numHists)
-	curHistID = new(uint32)
+	registry   atomic.Value
+	registerMu sync.Mutex
 )
 
+type histRegistry struct {
+	names []string
+	hists []*hist
+}
+
 func init() {
-	// start at "-1" so the first ID is 0
-	atomic.StoreUint32(curHistID, 0xFFFFFFFF)
+	registry.Store(&histRegistry{})
 }
 
-// The hist struct holds a primary and secondary data structure so the reader of
-// the histograms will get to read the data out while new observations are made.
-// As well, pulling and resetting the histogram does not require a malloc in the
-// path of pulling the data, and the large circular buffers can be reused.
+// registerHist appends h under name to the registry and returns its id,
+// growing the registry as needed instead of panicking once some fixed
+// count of histograms has been registered.
+func registerHist(name string, h *hist) uint32 {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	old := registry.Load().(*histRegistry)
+	idx := uint32(len(old.hists))
+
+	names := make([]string, idx+1)
+	copy(names, old.names)
+	names[idx] = name
+
+	hs := make([]*hist, idx+1)
+	copy(hs, old.hists)
+	hs[idx] = h
+
+	registry.Store(&histRegistry{names: names, hists: hs})
+
+	return idx
+}
+
+// The hist struct holds two hdats, one "hot" for writes and one "cold" for
+// extraction, so the reader of the histograms can pull data out while new
+// observations are made. Which hdat is hot is tracked entirely through
+// countAndHotIdx, so neither ObserveHist nor extractAndReset ever takes a
+// lock on the observation path.
 type hist struct {
-	lock sync.RWMutex
-	rand *rand.Rand
-	prim *hdat
-	sec  *hdat
+	// countAndHotIdx packs a monotonically-incrementing observation
+	// counter into the low 63 bits and the index (0 or 1) of the hot
+	// hdat into the high bit. ObserveHist bumps it by 1 per observation
+	// and reads back which hdat is hot. extractAndReset bumps it by
+	// 1<<63, which flips the hot index without disturbing the counter,
+	// then spins until the now-cold hdat's own counter shows every
+	// observation that had already started against it has finished
+	// writing.
+	countAndHotIdx *uint64
+	dat            [2]*hdat
+
+	// upperBounds is nil for a plain reservoir histogram. When set (by
+	// AddBucketedHistogram), ObserveHist also increments the bucket
+	// whose upper bound is the first to be >= the observed value.
+	// Shared and read-only for the lifetime of the histogram.
+	upperBounds []float64
+
+	// sparse is set instead of dat/upperBounds for a histogram created
+	// with AddSparseHistogram, which doesn't use the hot/cold dat
+	// buffers at all.
+	sparse *sparseDat
+}
+
+// sparseDat is a native/sparse exponential-bucket histogram: buckets are
+// defined implicitly by the schema rather than stored as an explicit list
+// of bounds, so populated buckets are tracked in maps keyed by bucket
+// index instead of a fixed-size slice. positive and negative each hold an
+// immutable map[int32]*uint64, copy-on-write like the top-level registry,
+// so a bucket lookup on the observation path is a single atomic.Value
+// load with no lock; lock is only taken to build and swap in a grown
+// copy of the map when a new bucket index shows up.
+type sparseDat struct {
+	schema        int32
+	zeroThreshold float64
+
+	lock sync.Mutex
+
+	zeroCount *uint64
+	sum       *uint64
+	count     *uint64
+
+	positive atomic.Value // map[int32]*uint64
+	negative atomic.Value // map[int32]*uint64
 }
 type hdat struct {
+	// epochStart is the value of countAndHotIdx's counter bits at the
+	// moment this hdat most recently became hot; it lets extractAndReset
+	// work out how many observations were issued during the epoch that
+	// just ended.
+	epochStart *uint64
+	// count is the number of observations fully written to this hdat
+	// since its last reset. Incrementing it is also the signal
+	// extractAndReset waits on before it's safe to drain the buffer.
 	count *uint64
 	min   *uint64
 	max   *uint64
 	buf   []uint64
+
+	// buckets and sum are only populated for bucketed histograms.
+	// buckets[i] counts observations that fell in upperBounds[i] and
+	// below no smaller upperBound; sum holds the float64 bits of the
+	// running total of observed values.
+	buckets []uint64
+	sum     *uint64
 }
 
 func newHist() *hist {
 	return &hist{
-		rand: rand.New(rand.NewSource(seed())),
-		prim: newHdat(),
-		sec:  newHdat(),
+		countAndHotIdx: new(uint64),
+		dat:            [2]*hdat{newHdat(0), newHdat(0)},
 	}
 }
-func newHdat() *hdat {
-	ret := &hdat{
-		count: new(uint64),
-		min:   new(uint64),
-		max:   new(uint64),
-		buf:   make([]uint64, buflen),
-	}
-	atomic.StoreUint64(ret.min, math.MaxUint64)
-	return ret
+
+// AddBucketedHistogram registers a histogram that, alongside the usual
+// reservoir sample, tracks one counter per bucket in upperBounds plus a
+// running sum, giving accurate quantiles from a bounded footprint instead
+// of relying on the reservoir's sampling. upperBounds must be sorted in
+// ascending order; LinearBuckets and ExponentialBuckets build one.
+func AddBucketedHistogram(name string, upperBounds []float64) uint32 {
+	bounds := make([]float64, len(upperBounds))
+	copy(bounds, upperBounds)
+
+	return registerHist(name, &hist{
+		countAndHotIdx: new(uint64),
+		dat:            [2]*hdat{newHdat(len(bounds)), newHdat(len(bounds))},
+		upperBounds:    bounds,
+	})
 }
 
-func seed() int64 {
-	b := make([]byte, 8)
-	if _, err := crand.Read(b); err != nil {
-		panic(err.Error())
+// LinearBuckets returns count bucket upper bounds, the lowest at start and
+// each following one width higher than the last.
+func LinearBuckets(start, width float64, count int) []float64 {
+	if count < 1 {
+		panic("LinearBuckets needs a positive count")
 	}
-	var ret int64
-	binary.Read(bytes.NewBuffer(b), binary.LittleEndian, &ret)
-	return ret
+
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start += width
+	}
+	return buckets
 }
 
-func AddHistogram(name string) uint32 {
-	idx := atomic.AddUint32(curHistID, 1)
+// ExponentialBuckets returns count bucket upper bounds, the lowest at
+// start and each following one factor times the last.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if count < 1 {
+		panic("ExponentialBuckets needs a positive count")
+	}
+	if start <= 0 {
+		panic("ExponentialBuckets needs a positive start value")
+	}
+	if factor <= 1 {
+		panic("ExponentialBuckets needs a factor greater than 1")
+	}
 
-	if idx >= numHists {
-		panic("Too many histograms")
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
 	}
+	return buckets
+}
 
-	hnames[idx] = name
-	hists[idx] = newHist()
+// AddSparseHistogram registers a native/sparse exponential-bucket
+// histogram, giving bounded relative error across many orders of
+// magnitude at a tiny memory cost compared to a fixed-size reservoir or
+// an explicit bucket list. schema controls the growth factor between
+// adjacent buckets (2^(2^-schema); -4 gives 65536x, 8 gives about 1.003x)
+// and typically ranges from -4 to 8. zeroThreshold is the absolute value
+// below which observations are counted in the zero bucket instead of
+// being assigned a bucket index.
+func AddSparseHistogram(name string, schema int32, zeroThreshold float64) uint32 {
+	s := &sparseDat{
+		schema:        schema,
+		zeroThreshold: zeroThreshold,
+		zeroCount:     new(uint64),
+		sum:           new(uint64),
+		count:         new(uint64),
+	}
+	s.positive.Store(make(map[int32]*uint64))
+	s.negative.Store(make(map[int32]*uint64))
 
-	return idx
+	return registerHist(name, &hist{sparse: s})
+}
+
+func newHdat(nBuckets int) *hdat {
+	ret := &hdat{
+		epochStart: new(uint64),
+		count:      new(uint64),
+		min:        new(uint64),
+		max:        new(uint64),
+		buf:        make([]uint64, buflen+1),
+		sum:        new(uint64),
+	}
+	if nBuckets > 0 {
+		ret.buckets = make([]uint64, nBuckets)
+	}
+	atomic.StoreUint64(ret.min, math.MaxUint64)
+	return ret
+}
+
+func AddHistogram(name string) uint32 {
+	return registerHist(name, newHist())
 }
 
 func ObserveHist(id uint32, value uint64) {
-	h := hists[id]
+	h := registry.Load().(*histRegistry).hists[id]
+
+	if h.sparse != nil {
+		observeSparse(h.sparse, float64(value))
+		return
+	}
 
-	// We lock here to ensure that the min and max values are true to this time
-	// period, meaning extractAndReset won't pull the data out from under us
-	// while the current observation is being compared. Otherwise, min and max
-	// could come from the previous period on the next read.
-	h.lock.RLock()
-	defer h.lock.RUnlock()
+	// The single atomic add both stakes out this observation's ring
+	// buffer position (the low 63 bits) and tells us which hdat is hot
+	// right now (the high bit), with no lock needed.
+	n := atomic.AddUint64(h.countAndHotIdx, 1)
+	hot := h.dat[n>>63]
 
 	// Set max and min (if needed) in an atomic fashion
 	for {
-		max := atomic.LoadUint64(h.prim.max)
-		if value < max || atomic.CompareAndSwapUint64(h.prim.max, max, value) {
+		max := atomic.LoadUint64(hot.max)
+		if value < max || atomic.CompareAndSwapUint64(hot.max, max, value) {
 			break
 		}
 	}
 	for {
-		min := atomic.LoadUint64(h.prim.min)
-		if value > min || atomic.CompareAndSwapUint64(h.prim.min, min, value) {
+		min := atomic.LoadUint64(hot.min)
+		if value > min || atomic.CompareAndSwapUint64(hot.min, min, value) {
 			break
 		}
 	}
 
-	// Sample at a fixed rate
-	if h.rand.Float64() > sampleRate {
-		return
-	}
+	idx := n &^ (1 << 63)
+	hot.buf[idx&buflen] = value
 
-	// Get the current index as the count % buflen
-	idx := atomic.AddUint64(h.prim.count, 1)
-	idx &= buflen
+	if len(h.upperBounds) > 0 {
+		v := float64(value)
+		for i, upper := range h.upperBounds {
+			if upper >= v {
+				atomic.AddUint64(&hot.buckets[i], 1)
+				break
+			}
+		}
+		for {
+			oldBits := atomic.LoadUint64(hot.sum)
+			newBits := math.Float64bits(math.Float64frombits(oldBits) + v)
+			if atomic.CompareAndSwapUint64(hot.sum, oldBits, newBits) {
+				break
+			}
+		}
+	}
 
-	// Add observation
-	h.prim.buf[idx] = value
+	// Increment count last, since extractAndReset takes it as the signal
+	// that this observation is complete.
+	atomic.AddUint64(hot.count, 1)
 }
 
 func getAllHistograms() ([]string, []*hdat) {
-	n := int(atomic.LoadUint32(curHistID))
+	reg := registry.Load().(*histRegistry)
+	retdat := make([]*hdat, len(reg.hists))
+
+	for i, h := range reg.hists {
+		// Sparse histograms don't use hdat at all; they're drained
+		// separately through ExtractSparseHistogram.
+		if h.sparse != nil {
+			continue
+		}
+		retdat[i] = extractAndReset(h)
+	}
+
+	return reg.names, retdat
+}
+
+func extractAndReset(h *hist) *hdat {
+	// Reset the cold hdat while it is still cold, so it's clean for the
+	// observations that will land on it once the flip below makes it hot.
+	// Nothing writes to it now: the previous extraction waited out every
+	// observation of its last epoch.
+	next := h.dat[(atomic.LoadUint64(h.countAndHotIdx)>>63)^1]
+	atomic.StoreUint64(next.count, 0)
+	atomic.StoreUint64(next.max, 0)
+	atomic.StoreUint64(next.min, math.MaxUint64)
+	atomic.StoreUint64(next.sum, 0)
+	for i := range next.buckets {
+		atomic.StoreUint64(&next.buckets[i], 0)
+	}
+
+	// Flip the hot index without touching the counter bits.
+	n := atomic.AddUint64(h.countAndHotIdx, 1<<63)
+	total := n &^ (1 << 63)
+	hot := h.dat[n>>63]
+	cold := h.dat[(n>>63)^1]
+
+	// cold was hot during the epoch that just ended; wait until every
+	// observation started against it in that epoch has finished writing
+	// before we drain it.
+	started := total - atomic.LoadUint64(cold.epochStart)
+	for started != atomic.LoadUint64(cold.count) {
+		runtime.Gosched()
+	}
+
+	// hot started its own epoch at the flip; record where it began.
+	atomic.StoreUint64(hot.epochStart, total)
+
+	return cold
+}
+
+// WriteBucketedHistogram writes d's bucket counts, sum and count in
+// Prometheus text exposition format under name, assuming d came from a
+// histogram created with AddBucketedHistogram using upperBounds. Bucket
+// counts are emitted cumulatively, as Prometheus' "le" buckets require.
+func WriteBucketedHistogram(w io.Writer, name string, upperBounds []float64, d *hdat) error {
+	cumulative := uint64(0)
+	for i, upper := range upperBounds {
+		cumulative += atomic.LoadUint64(&d.buckets[i])
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatBucketBound(upper), cumulative); err != nil {
+			return err
+		}
+	}
+
+	total := atomic.LoadUint64(d.count)
+	if _, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total); err != nil {
+		return err
+	}
+
+	sum := math.Float64frombits(atomic.LoadUint64(d.sum))
+	if _, err := fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(sum, 'g', -1, 64)); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s_count %d\n", name, total)
+	return err
+}
+
+func formatBucketBound(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func observeSparse(s *sparseDat, v float64) {
+	abs := math.Abs(v)
+
+	if abs <= s.zeroThreshold {
+		atomic.AddUint64(s.zeroCount, 1)
+	} else {
+		buckets := &s.positive
+		if v < 0 {
+			buckets = &s.negative
+		}
+		idx := sparseBucketIndex(s.schema, abs)
+
+		m := buckets.Load().(map[int32]*uint64)
+		counter, ok := m[idx]
+
+		if !ok {
+			s.lock.Lock()
+			m = buckets.Load().(map[int32]*uint64)
+			counter, ok = m[idx]
+			if !ok {
+				grown := make(map[int32]*uint64, len(m)+1)
+				for k, c := range m {
+					grown[k] = c
+				}
+				counter = new(uint64)
+				grown[idx] = counter
+				buckets.Store(grown)
+			}
+			s.lock.Unlock()
+		}
+
+		atomic.AddUint64(counter, 1)
+	}
 
-	retnames := hnames[:n]
-	retdat := make([]*hdat, n)
+	for {
+		oldBits := atomic.LoadUint64(s.sum)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + v)
+		if atomic.CompareAndSwapUint64(s.sum, oldBits, newBits) {
+			break
+		}
+	}
+	atomic.AddUint64(s.count, 1)
+}
+
+// sparseBucketIndex returns the index of the bucket abs falls in under
+// schema: bucket_index = ceil(log(abs) / log(2^2^-schema)), which
+// simplifies to ceil(log2(abs) * 2^schema). math.Frexp gives the exponent
+// half of log2(abs) for free, and fastLog2Frac approximates the
+// fractional half without a call to math.Log (which math.Log2 itself
+// would make on the fractional part), keeping this on the hot
+// observation path cheap. The 2^schema factor is built with a shift
+// rather than math.Pow. Because log2 is approximated, a value near a
+// bucket boundary can get a neighbouring index instead of the exact one,
+// off by up to about 0.01 * 2^schema buckets; exact powers of two always
+// get their exact index.
+func sparseBucketIndex(schema int32, abs float64) int32 {
+	frac, exp := math.Frexp(abs)
+	log2 := float64(exp) + fastLog2Frac(frac)
 
-	for i := 0; i < n; i++ {
-		retdat[i] = extractAndReset(i)
+	var scaled float64
+	if schema >= 0 {
+		scaled = log2 * float64(int64(1)<<uint(schema))
+	} else {
+		scaled = log2 / float64(int64(1)<<uint(-schema))
 	}
+	return int32(math.Ceil(scaled))
+}
+
+// fastLog2Frac approximates log2(frac) for frac in [0.5, 1), the range
+// math.Frexp's fraction is always returned in, using the quadratic fit
+// -4/3*frac^2 + 4*frac - 8/3 (Turner's approximation, derived from the
+// equivalent fit over a [1,2) mantissa). It's exact at the endpoints
+// (frac=0.5 gives -1, frac=1 gives 0) and within about 0.01 in between,
+// using only multiplies and adds instead of a transcendental call.
+func fastLog2Frac(frac float64) float64 {
+	return -4.0/3.0*frac*frac + 4.0*frac - 8.0/3.0
+}
 
-	return retnames, retdat
+// sparseBucket is one populated bucket returned by ExtractSparseHistogram.
+type sparseBucket struct {
+	Index int32
+	Count uint64
 }
 
-func extractAndReset(id int) *hdat {
-	h := hists[id]
+// ExtractSparseHistogram drains and resets the sparse histogram
+// registered under id, returning its schema, zero bucket, running sum and
+// count, and its positive and negative buckets sorted by index.
+func ExtractSparseHistogram(id uint32) (schema int32, zeroThreshold float64, zeroCount uint64, sum float64, count uint64, positive, negative []sparseBucket) {
+	s := registry.Load().(*histRegistry).hists[id].sparse
 
-	h.lock.Lock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	// flip and reset the count
-	temp := h.prim
-	h.prim = h.sec
-	h.sec = temp
+	schema = s.schema
+	zeroThreshold = s.zeroThreshold
+	zeroCount = atomic.SwapUint64(s.zeroCount, 0)
+	sum = math.Float64frombits(atomic.SwapUint64(s.sum, 0))
+	count = atomic.SwapUint64(s.count, 0)
 
-	atomic.StoreUint64(h.prim.count, 0)
-	atomic.StoreUint64(h.prim.max, 0)
-	atomic.StoreUint64(h.prim.min, math.MaxUint64)
+	positive = drainSparseBuckets(s.positive.Load().(map[int32]*uint64))
+	negative = drainSparseBuckets(s.negative.Load().(map[int32]*uint64))
 
-	h.lock.Unlock()
+	return
+}
 
-	return h.sec
+func drainSparseBuckets(buckets map[int32]*uint64) []sparseBucket {
+	ret := make([]sparseBucket, 0, len(buckets))
+	for idx, counter := range buckets {
+		ret = append(ret, sparseBucket{Index: idx, Count: atomic.SwapUint64(counter, 0)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Index < ret[j].Index })
+	return ret
 }
@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRegistryGrowsPastOldCap registers well over the registry's old
+// fixed cap of 100 histograms and checks that none of it panics and
+// every id still resolves to the right name and data.
+func TestRegistryGrowsPastOldCap(t *testing.T) {
+	const n = 150
+
+	ids := make([]uint32, n)
+	for i := 0; i < n; i++ {
+		ids[i] = AddHistogram(fmt.Sprintf("test-registry-growth-%d", i))
+	}
+
+	for i, id := range ids {
+		ObserveHist(id, uint64(i))
+	}
+
+	names, dats := getAllHistograms()
+	for i, id := range ids {
+		wantName := fmt.Sprintf("test-registry-growth-%d", i)
+		if names[id] != wantName {
+			t.Fatalf("names[%d] = %q, want %q", id, names[id], wantName)
+		}
+		if got := atomic.LoadUint64(dats[id].count); got != 1 {
+			t.Errorf("dats[%d].count = %d, want 1", id, got)
+		}
+	}
+}
+
+// TestExtractAndResetReservoir observes a known set of values into a plain
+// reservoir histogram and checks that extraction reports the count, min
+// and max of that epoch rather than a reset-before-read zero.
+func TestExtractAndResetReservoir(t *testing.T) {
+	id := AddHistogram("test-extract-reservoir")
+
+	for v := uint64(1); v <= 100; v++ {
+		ObserveHist(id, v)
+	}
+
+	names, dats := getAllHistograms()
+	d := dats[id]
+
+	if names[id] != "test-extract-reservoir" {
+		t.Fatalf("names[id] = %q, want test-extract-reservoir", names[id])
+	}
+	if got := atomic.LoadUint64(d.count); got != 100 {
+		t.Errorf("count = %d, want 100", got)
+	}
+	if got := atomic.LoadUint64(d.min); got != 1 {
+		t.Errorf("min = %d, want 1", got)
+	}
+	if got := atomic.LoadUint64(d.max); got != 100 {
+		t.Errorf("max = %d, want 100", got)
+	}
+
+	// A second, empty epoch should extract as all-zero, proving the reset
+	// happened on the buffer that's about to take new writes rather than
+	// the one just handed back above.
+	_, dats = getAllHistograms()
+	d2 := dats[id]
+	if got := atomic.LoadUint64(d2.count); got != 0 {
+		t.Errorf("second epoch count = %d, want 0", got)
+	}
+	if got := atomic.LoadUint64(d2.min); got != math.MaxUint64 {
+		t.Errorf("second epoch min = %d, want MaxUint64", got)
+	}
+}
+
+// TestSparseHistogram checks accumulation and extraction for a native
+// sparse histogram, including the zero bucket.
+func TestSparseHistogram(t *testing.T) {
+	id := AddSparseHistogram("test-sparse", 2, 0.001)
+
+	s := registry.Load().(*histRegistry).hists[id].sparse
+	for _, v := range []float64{0, 1, 1, -1, 10} {
+		observeSparse(s, v)
+	}
+
+	schema, zeroThreshold, zeroCount, sum, count, positive, negative := ExtractSparseHistogram(id)
+
+	if schema != 2 {
+		t.Errorf("schema = %d, want 2", schema)
+	}
+	if zeroThreshold != 0.001 {
+		t.Errorf("zeroThreshold = %v, want 0.001", zeroThreshold)
+	}
+	if zeroCount != 1 {
+		t.Errorf("zeroCount = %d, want 1", zeroCount)
+	}
+	if count != 5 {
+		t.Errorf("count = %d, want 5", count)
+	}
+	if sum != 11 {
+		t.Errorf("sum = %v, want 11", sum)
+	}
+	if len(positive) != 2 {
+		t.Fatalf("positive buckets = %v, want 2 entries", positive)
+	}
+	if len(negative) != 1 {
+		t.Fatalf("negative buckets = %v, want 1 entry", negative)
+	}
+	if positive[0].Count != 2 {
+		t.Errorf("bucket for value 1 count = %d, want 2", positive[0].Count)
+	}
+}
+
+// TestBucketedHistogram checks that observations land in the right
+// cumulative buckets and that WriteBucketedHistogram renders them.
+func TestBucketedHistogram(t *testing.T) {
+	bounds := LinearBuckets(10, 10, 3) // 10, 20, 30
+	id := AddBucketedHistogram("test-bucketed", bounds)
+
+	for _, v := range []uint64{5, 15, 15, 25, 100} {
+		ObserveHist(id, v)
+	}
+
+	_, dats := getAllHistograms()
+	d := dats[id]
+
+	var buf bytes.Buffer
+	if err := WriteBucketedHistogram(&buf, "test_bucketed", bounds, d); err != nil {
+		t.Fatalf("WriteBucketedHistogram: %v", err)
+	}
+
+	want := "test_bucketed_bucket{le=\"10\"} 1\n" +
+		"test_bucketed_bucket{le=\"20\"} 3\n" +
+		"test_bucketed_bucket{le=\"30\"} 4\n" +
+		"test_bucketed_bucket{le=\"+Inf\"} 5\n" +
+		"test_bucketed_sum 160\n" +
+		"test_bucketed_count 5\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteBucketedHistogram output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// BenchmarkObserveHist measures the lock-free observation fast path on its
+// own, with no concurrent extraction.
+func BenchmarkObserveHist(b *testing.B) {
+	id := AddHistogram("bench-observe")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var v uint64
+		for pb.Next() {
+			v++
+			ObserveHist(id, v)
+		}
+	})
+}
+
+// BenchmarkObserveHistWithConcurrentExtract measures the same fast path
+// while extractAndReset is continuously flipping hot and cold in the
+// background, which is the case the lock-free swap is meant to help.
+func BenchmarkObserveHistWithConcurrentExtract(b *testing.B) {
+	id := AddHistogram("bench-observe-concurrent-extract")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				getAllHistograms()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var v uint64
+		for pb.Next() {
+			v++
+			ObserveHist(id, v)
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	wg.Wait()
+}
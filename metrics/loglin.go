@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+)
+
+// logLinBucket is one populated bucket of a LogLinHistogram: value
+// magnitudes with base-10 exponent exp and mantissa val (10..99,
+// representing the leading two digits of values in that decade) all land
+// in the same bucket, giving about 5% relative error uniformly across the
+// whole range.
+type logLinBucket struct {
+	exp   int8
+	val   uint8
+	count uint64
+}
+
+// LogLinHistogram is a Circonus-style log-linear histogram: buckets are
+// keyed by (exponent, mantissa) rather than preallocated, so memory scales
+// with the number of distinct populated buckets instead of the number of
+// observations. That makes it cheap to merge histograms gathered on
+// different rend nodes into one without losing quantile accuracy, which
+// the sampling reservoir can't do.
+//
+// Unlike hist's hot/cold buffers or sparseDat's map, the bucket slice here
+// is mutated in place by append/copy on every Observe, so it's guarded by
+// a plain mutex rather than a lock-free scheme.
+type LogLinHistogram struct {
+	mu      sync.Mutex
+	buckets []logLinBucket // sorted by (exp, val)
+}
+
+// Observe records v in its (exponent, mantissa) bucket. Safe for
+// concurrent use by multiple goroutines.
+func (h *LogLinHistogram) Observe(v float64) {
+	exp, val := logLinBucketFor(v)
+	h.mu.Lock()
+	h.increment(exp, val, 1)
+	h.mu.Unlock()
+}
+
+// Merge unions other into h by summing counts on matching buckets, adding
+// any bucket from other that h doesn't yet have. Safe for concurrent use
+// by multiple goroutines.
+func (h *LogLinHistogram) Merge(other *LogLinHistogram) {
+	other.mu.Lock()
+	otherBuckets := make([]logLinBucket, len(other.buckets))
+	copy(otherBuckets, other.buckets)
+	other.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, b := range otherBuckets {
+		h.increment(b.exp, b.val, b.count)
+	}
+}
+
+// Quantile returns an estimate of the qth quantile (0 <= q <= 1) of the
+// observed values, computed by walking the sorted buckets until the
+// target rank is reached and returning that bucket's midpoint.
+func (h *LogLinHistogram) Quantile(q float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buckets) == 0 {
+		return 0
+	}
+
+	var total uint64
+	for _, b := range h.buckets {
+		total += b.count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	target := q * float64(total)
+	var cumulative uint64
+	for _, b := range h.buckets {
+		cumulative += b.count
+		if float64(cumulative) >= target {
+			return bucketMidpoint(b.exp, b.val)
+		}
+	}
+
+	last := h.buckets[len(h.buckets)-1]
+	return bucketMidpoint(last.exp, last.val)
+}
+
+// MarshalBinary serializes h into a compact form suitable for shipping
+// over the wire: a bucket count followed by exp/val/count triples in
+// sorted order.
+func (h *LogLinHistogram) MarshalBinary() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buf := make([]byte, 4+len(h.buckets)*10)
+	binary.BigEndian.PutUint32(buf, uint32(len(h.buckets)))
+
+	off := 4
+	for _, b := range h.buckets {
+		buf[off] = byte(b.exp)
+		buf[off+1] = b.val
+		binary.BigEndian.PutUint64(buf[off+2:off+10], b.count)
+		off += 10
+	}
+
+	return buf, nil
+}
+
+// UnmarshalBinary replaces h's buckets with the ones encoded in data by
+// MarshalBinary.
+func (h *LogLinHistogram) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("loglin: short buffer")
+	}
+
+	n := int(binary.BigEndian.Uint32(data))
+	if len(data) != 4+n*10 {
+		return errors.New("loglin: truncated buffer")
+	}
+
+	buckets := make([]logLinBucket, n)
+	off := 4
+	for i := 0; i < n; i++ {
+		buckets[i] = logLinBucket{
+			exp:   int8(data[off]),
+			val:   data[off+1],
+			count: binary.BigEndian.Uint64(data[off+2 : off+10]),
+		}
+		off += 10
+	}
+
+	h.mu.Lock()
+	h.buckets = buckets
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *LogLinHistogram) increment(exp int8, val uint8, count uint64) {
+	i := sort.Search(len(h.buckets), func(i int) bool {
+		b := h.buckets[i]
+		if b.exp != exp {
+			return b.exp > exp
+		}
+		return b.val >= val
+	})
+
+	if i < len(h.buckets) && h.buckets[i].exp == exp && h.buckets[i].val == val {
+		h.buckets[i].count += count
+		return
+	}
+
+	h.buckets = append(h.buckets, logLinBucket{})
+	copy(h.buckets[i+1:], h.buckets[i:])
+	h.buckets[i] = logLinBucket{exp: exp, val: val, count: count}
+}
+
+// logLinBucketFor computes the (exponent, mantissa) bucket for v, using
+// the leading two significant digits of |v| as the mantissa (10..99) and
+// the base-10 exponent of |v| as exp.
+func logLinBucketFor(v float64) (int8, uint8) {
+	abs := math.Abs(v)
+	if abs == 0 {
+		return 0, 10
+	}
+
+	exp := int(math.Floor(math.Log10(abs)))
+	// Scale so the leading two digits land in [10, 100).
+	mantissa := abs / math.Pow(10, float64(exp-1))
+	val := int(mantissa)
+	if val < 10 {
+		val = 10
+	} else if val > 99 {
+		// Log10 rounded just below an exact power of ten, so abs is
+		// really 10^(exp+1) and its leading two digits are 10.
+		val = 10
+		exp++
+	}
+
+	return int8(exp), uint8(val)
+}
+
+// bucketMidpoint returns the representative value of the (exp, val)
+// bucket, used as the quantile estimate when that bucket is selected.
+func bucketMidpoint(exp int8, val uint8) float64 {
+	return (float64(val) + 0.5) * math.Pow(10, float64(exp)-1)
+}
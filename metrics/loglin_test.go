@@ -0,0 +1,84 @@
+package metrics
+
+import "testing"
+
+// TestLogLinObserveAndQuantile checks that Observe buckets values by their
+// leading two digits and that Quantile walks those buckets to a sane
+// estimate.
+func TestLogLinObserveAndQuantile(t *testing.T) {
+	var h LogLinHistogram
+	for _, v := range []float64{10, 10, 20, 30, 100} {
+		h.Observe(v)
+	}
+
+	if got := h.Quantile(0); got < 10 || got > 11 {
+		t.Errorf("Quantile(0) = %v, want ~10", got)
+	}
+	if got := h.Quantile(1); got < 100 || got > 110 {
+		t.Errorf("Quantile(1) = %v, want ~100-110", got)
+	}
+}
+
+// TestLogLinMerge checks that Merge unions bucket counts from another
+// histogram rather than replacing or dropping them.
+func TestLogLinMerge(t *testing.T) {
+	var a, b LogLinHistogram
+	for _, v := range []float64{10, 20} {
+		a.Observe(v)
+	}
+	for _, v := range []float64{10, 30} {
+		b.Observe(v)
+	}
+
+	a.Merge(&b)
+
+	var total uint64
+	for _, bucket := range a.buckets {
+		total += bucket.count
+	}
+	if total != 4 {
+		t.Errorf("total count after merge = %d, want 4", total)
+	}
+
+	exp, val := logLinBucketFor(10)
+	found := false
+	for _, bucket := range a.buckets {
+		if bucket.exp == exp && bucket.val == val {
+			found = true
+			if bucket.count != 2 {
+				t.Errorf("bucket(10) count = %d, want 2", bucket.count)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("bucket(10) missing after merge")
+	}
+}
+
+// TestLogLinMarshalRoundTrip checks that MarshalBinary/UnmarshalBinary
+// preserve bucket contents.
+func TestLogLinMarshalRoundTrip(t *testing.T) {
+	var h LogLinHistogram
+	for _, v := range []float64{10, 20, 20, 99} {
+		h.Observe(v)
+	}
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	var got LogLinHistogram
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	if len(got.buckets) != len(h.buckets) {
+		t.Fatalf("bucket count = %d, want %d", len(got.buckets), len(h.buckets))
+	}
+	for i, bucket := range h.buckets {
+		if got.buckets[i] != bucket {
+			t.Errorf("bucket[%d] = %+v, want %+v", i, got.buckets[i], bucket)
+		}
+	}
+}